@@ -1,15 +1,28 @@
 package buildpack
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -23,7 +36,18 @@ type ManifestEntry struct {
 	Dependency Dependency `yaml:",inline"`
 	URI        string     `yaml:"uri"`
 	MD5        string     `yaml:"md5"`
+	SHA256     string     `yaml:"sha256"`
+	SHA512     string     `yaml:"sha512"`
+	Signature  string     `yaml:"signature"`
 	CFStacks   []string   `yaml:"cf_stacks"`
+
+	// OS, Arch, and ArchVariant narrow an entry to a single platform, for
+	// manifests that ship one buildpack across multiple CPU
+	// architectures (e.g. linux/amd64 and linux/arm64 cflinuxfs stacks).
+	// An empty value matches any platform.
+	OS          string `yaml:"os"`
+	Arch        string `yaml:"arch"`
+	ArchVariant string `yaml:"arch_variant"`
 }
 
 type Manifest struct {
@@ -31,6 +55,129 @@ type Manifest struct {
 	DefaultVersions []Dependency    `yaml:"default_versions"`
 	ManifestEntries []ManifestEntry `yaml:"dependencies"`
 	ManifestRootDir string
+
+	// SignaturePublicKey, when set, is used to verify the detached,
+	// base64-encoded ed25519 signature in a ManifestEntry's Signature
+	// field, so a swapped binary is rejected even when its checksum in
+	// manifest.yml was changed to match. Entries with an empty Signature
+	// are not checked against the key.
+	SignaturePublicKey ed25519.PublicKey
+
+	// HTTPClient is used by the built-in http(s) source for every
+	// dependency fetch. It defaults to a client with a 10-minute overall
+	// request timeout; override it to point at a proxy or to tune timeouts
+	// for a slow network.
+	HTTPClient *http.Client
+
+	sources map[string]DependencySource
+	logger  Logger
+}
+
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+func (m *Manifest) WithLogger(logger Logger) *Manifest {
+	m.logger = logger
+	return m
+}
+
+func (m *Manifest) log() Logger {
+	if m.logger != nil {
+		return m.logger
+	}
+	return defaultLogger{}
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Debug(msg string, kv ...interface{}) { writeHumanLog(os.Stderr, "DEBUG", msg, kv) }
+func (defaultLogger) Info(msg string, kv ...interface{})  { writeHumanLog(os.Stderr, "INFO", msg, kv) }
+func (defaultLogger) Warn(msg string, kv ...interface{})  { writeHumanLog(os.Stderr, "WARN", msg, kv) }
+func (defaultLogger) Error(msg string, kv ...interface{}) { writeHumanLog(os.Stderr, "ERROR", msg, kv) }
+
+func writeHumanLog(w io.Writer, level, msg string, kv []interface{}) {
+	fmt.Fprintf(w, "%-5s %s", level, msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(w, " %v=%v", kv[i], kv[i+1])
+	}
+	fmt.Fprintln(w)
+}
+
+// JSONLogger writes one JSON object per line to Writer (stderr if unset).
+type JSONLogger struct {
+	Writer io.Writer
+}
+
+func (l JSONLogger) Debug(msg string, kv ...interface{}) { l.write("debug", msg, kv) }
+func (l JSONLogger) Info(msg string, kv ...interface{})  { l.write("info", msg, kv) }
+func (l JSONLogger) Warn(msg string, kv ...interface{})  { l.write("warn", msg, kv) }
+func (l JSONLogger) Error(msg string, kv ...interface{}) { l.write("error", msg, kv) }
+
+func (l JSONLogger) write(level, msg string, kv []interface{}) {
+	w := l.Writer
+	if w == nil {
+		w = os.Stderr
+	}
+
+	entry := map[string]interface{}{"level": level, "msg": msg}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprintf("%v", kv[i])
+		}
+		entry[key] = kv[i+1]
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	w.Write(append(data, '\n'))
+}
+
+type loggerContextKey struct{}
+
+func withLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+func loggerFromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(Logger); ok && logger != nil {
+		return logger
+	}
+	return defaultLogger{}
+}
+
+// DependencySource fetches a dependency identified by uri to dest.
+type DependencySource interface {
+	Schemes() []string
+	Fetch(ctx context.Context, uri, dest string) error
+}
+
+// RegisterSource registers source for each of the URI schemes it reports,
+// overriding any existing source for that scheme.
+func (m *Manifest) RegisterSource(source DependencySource) {
+	if m.sources == nil {
+		m.sources = map[string]DependencySource{}
+	}
+	for _, scheme := range source.Schemes() {
+		m.sources[scheme] = source
+	}
+}
+
+// registerDefaultSources wires up http(s) and file, the schemes every
+// buildpack needs. S3 and OCI support live in the s3source and ocisource
+// packages; register them explicitly with RegisterSource to opt in.
+func (m *Manifest) registerDefaultSources() {
+	if m.HTTPClient == nil {
+		m.HTTPClient = &http.Client{Timeout: 10 * time.Minute}
+	}
+	m.RegisterSource(httpSource{client: m.HTTPClient, maxRetries: 5})
+	m.RegisterSource(fileSource{})
 }
 
 func NewManifest(filename string) (*Manifest, error) {
@@ -50,6 +197,8 @@ func NewManifest(filename string) (*Manifest, error) {
 		return nil, err
 	}
 
+	m.registerDefaultSources()
+
 	return &m, nil
 }
 
@@ -74,50 +223,636 @@ func (m *Manifest) DefaultVersion(depName string) (string, error) {
 		return "", newBuildpackError(defaultVersionsError, "found %d default versions for %s", numDefaults, depName)
 	}
 
+	if isVersionConstraint(defaultVersion) {
+		resolved, err := m.ResolveDependency(depName, defaultVersion)
+		if err != nil {
+			return "", err
+		}
+		return resolved.Version, nil
+	}
+
 	return defaultVersion, nil
 }
 
+// ResolveDependency returns the entry for name whose version is the
+// highest that satisfies constraint (e.g. "~1.2", "^1.2.3", ">=1.4 <2",
+// "1.2.x"), narrowed to the host OS/arch and the current $CF_STACK.
+func (m *Manifest) ResolveDependency(name, constraint string) (Dependency, error) {
+	return m.ResolveDependencyFor(name, constraint, Target{
+		OS:    runtime.GOOS,
+		Arch:  runtime.GOARCH,
+		Stack: os.Getenv("CF_STACK"),
+	})
+}
+
+// ResolveDependencyFor is ResolveDependency narrowed to target.
+func (m *Manifest) ResolveDependencyFor(name, constraint string, target Target) (Dependency, error) {
+	var best *parsedVersion
+	var bestDep Dependency
+	found := false
+
+	for _, e := range m.ManifestEntries {
+		if e.Dependency.Name != name {
+			continue
+		}
+		if !stackMatches(e.CFStacks, target.Stack) {
+			continue
+		}
+		if e.OS != "" && e.OS != target.OS {
+			continue
+		}
+		if archScore(&e, target) < 0 {
+			continue
+		}
+
+		pv := parseVersion(e.Dependency.Version)
+
+		ok, err := pv.satisfies(constraint)
+		if err != nil {
+			return Dependency{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		if best == nil || pv.compare(*best) > 0 {
+			pvCopy := pv
+			best = &pvCopy
+			bestDep = e.Dependency
+		}
+		found = true
+	}
+
+	if !found {
+		return Dependency{}, newBuildpackError("FIXME", "no version of %s satisfies constraint %q for this stack", name, constraint)
+	}
+
+	return bestDep, nil
+}
+
+// LatestPatch returns the highest version of name whose major.minor line
+// matches minorLine (e.g. "1.2").
+func (m *Manifest) LatestPatch(name, minorLine string) (string, error) {
+	dep, err := m.ResolveDependency(name, "~"+minorLine)
+	if err != nil {
+		return "", err
+	}
+	return dep.Version, nil
+}
+
+// isVersionConstraint reports whether v looks like a version range rather
+// than a single pinned version.
+func isVersionConstraint(v string) bool {
+	return strings.ContainsAny(v, "^~<>= *") || strings.HasSuffix(v, ".x") || strings.HasSuffix(v, ".X")
+}
+
 func (m *Manifest) FetchDependency(dep Dependency, outputFile string) error {
 	entry, err := m.getEntry(dep)
+	if err != nil {
+		return err
+	}
+
+	return m.fetchEntry(entry, outputFile)
+}
+
+// Target narrows dependency selection to a specific platform.
+type Target struct {
+	OS          string
+	Arch        string
+	ArchVariant string
+	Stack       string
+}
 
+// FetchDependencyFor behaves like FetchDependency, but narrows candidate
+// entries to those matching target instead of the host OS/arch and
+// $CF_STACK.
+func (m *Manifest) FetchDependencyFor(dep Dependency, target Target, outputFile string) error {
+	entry, err := m.getEntryFor(dep, target)
 	if err != nil {
 		return err
 	}
 
+	return m.fetchEntry(entry, outputFile)
+}
+
+func (m *Manifest) fetchEntry(entry *ManifestEntry, outputFile string) error {
+	start := time.Now()
+
 	filteredURI, err := filterURI(entry.URI)
 	if err != nil {
 		return err
 	}
+	loggedURI := filteredURI
 
 	if m.isCached() {
 		r := strings.NewReplacer("/", "_", ":", "_", "?", "_", "&", "_")
 		dependenciesDir := filepath.Join(m.ManifestRootDir, "dependencies")
 		err = copyFile(filepath.Join(dependenciesDir, r.Replace(filteredURI)), outputFile)
 	} else {
-		err = downloadFile(entry.URI, outputFile)
+		var fetchedURI string
+		fetchedURI, err = m.fetch(context.Background(), entry.URI, outputFile, entry.cacheKey())
+		if filtered, ferr := filterURI(fetchedURI); ferr == nil {
+			loggedURI = filtered
+		}
 	}
 	if err != nil {
 		return err
 	}
 
-	err = checkMD5(outputFile, entry.MD5)
-	if err != nil {
+	m.warnIfMD5Only(entry)
+
+	checksums := entry.expectedChecksums()
+	signed := entry.Signature != "" && len(m.SignaturePublicKey) > 0
+
+	if len(checksums) > 0 {
+		err = checkChecksum(outputFile, checksums)
+		if err != nil {
+			os.Remove(outputFile)
+			m.log().Error("dependency.checksum_mismatch", "name", entry.Dependency.Name, "version", entry.Dependency.Version, "err", err.Error())
+			return err
+		}
+	} else if !signed {
 		os.Remove(outputFile)
+		err = newBuildpackError("FIXME", "no checksum or signature configured for %s", entry.Dependency.Name)
+		m.log().Error("dependency.unverified", "name", entry.Dependency.Name, "version", entry.Dependency.Version, "err", err.Error())
 		return err
 	}
 
-	fmt.Printf("Downloaded [%s]\n         to [%s]\n", filteredURI, outputFile)
+	if entry.Signature != "" {
+		err = verifySignature(outputFile, entry.Signature, m.SignaturePublicKey)
+		if err != nil {
+			os.Remove(outputFile)
+			m.log().Error("dependency.signature_invalid", "name", entry.Dependency.Name, "version", entry.Dependency.Version, "err", err.Error())
+			return err
+		}
+	}
+
+	if cacheKey := entry.cacheKey(); cacheKey != "" {
+		if cached, err := cachePath(cacheKey); err == nil {
+			// Best-effort: a cache write failure shouldn't fail a
+			// download we've already verified.
+			_ = copyFile(outputFile, cached)
+		}
+	}
+
+	var bytesWritten int64
+	if info, err := os.Stat(outputFile); err == nil {
+		bytesWritten = info.Size()
+	}
+
+	m.log().Info("dependency.fetched", "uri", loggedURI, "dest", outputFile, "bytes", bytesWritten, "elapsed", time.Since(start))
 
 	return nil
 }
 
+// warnIfMD5Only logs a deprecation warning for entries pinned only by MD5.
+func (m *Manifest) warnIfMD5Only(e *ManifestEntry) {
+	if e.MD5 != "" && e.SHA256 == "" && e.SHA512 == "" {
+		m.log().Warn("dependency.md5_only_deprecated", "name", e.Dependency.Name, "version", e.Dependency.Version)
+	}
+}
+
+// expectedChecksums returns the digests configured on the entry, keyed by
+// algorithm name.
+func (e *ManifestEntry) expectedChecksums() map[string]string {
+	expected := map[string]string{}
+
+	if e.SHA512 != "" {
+		expected["sha512"] = e.SHA512
+	}
+	if e.SHA256 != "" {
+		expected["sha256"] = e.SHA256
+	}
+	if e.MD5 != "" {
+		expected["md5"] = e.MD5
+	}
+
+	return expected
+}
+
+// cacheKey returns a filename-safe identifier for the entry's strongest
+// configured digest, or "" if it has none.
+func (e *ManifestEntry) cacheKey() string {
+	expected := e.expectedChecksums()
+	for _, algorithm := range []string{"sha512", "sha256", "md5"} {
+		if digest, ok := expected[algorithm]; ok {
+			return algorithm + "-" + digest
+		}
+	}
+	return ""
+}
+
 func (m *Manifest) getEntry(dep Dependency) (*ManifestEntry, error) {
-	for _, e := range m.ManifestEntries {
-		if e.Dependency == dep {
-			return &e, nil
+	target := Target{
+		OS:    runtime.GOOS,
+		Arch:  runtime.GOARCH,
+		Stack: os.Getenv("CF_STACK"),
+	}
+
+	entry, err := m.getEntryFor(dep, target)
+	if err != nil {
+		return nil, newBuildpackError("FIXME", "dependency %s %s not found", dep.Name, dep.Version)
+	}
+	return entry, nil
+}
+
+// getEntryFor finds the best entry for dep narrowed to target, ranking
+// matches by architecture specificity.
+func (m *Manifest) getEntryFor(dep Dependency, target Target) (*ManifestEntry, error) {
+	var best *ManifestEntry
+	bestScore := -1
+
+	for i := range m.ManifestEntries {
+		e := &m.ManifestEntries[i]
+		if e.Dependency != dep {
+			continue
+		}
+		if !stackMatches(e.CFStacks, target.Stack) {
+			continue
+		}
+		if e.OS != "" && e.OS != target.OS {
+			continue
+		}
+
+		score := archScore(e, target)
+		if score < 0 {
+			continue
+		}
+		if score > bestScore {
+			bestScore = score
+			best = e
+		}
+	}
+
+	if best == nil {
+		return nil, newBuildpackError("FIXME", "no entry for %s %s matching os=%s arch=%s arch_variant=%s stack=%s",
+			dep.Name, dep.Version, target.OS, target.Arch, target.ArchVariant, target.Stack)
+	}
+	return best, nil
+}
+
+// archScore ranks how specifically e's Arch/ArchVariant match target,
+// highest first; negative means no match.
+func archScore(e *ManifestEntry, target Target) int {
+	switch {
+	case e.Arch == "":
+		return 1
+	case e.Arch != target.Arch:
+		return -1
+	case e.ArchVariant != "" && e.ArchVariant == target.ArchVariant:
+		return 3
+	case e.ArchVariant == "":
+		return 2
+	default:
+		return -1
+	}
+}
+
+// stackMatches reports whether entryStacks permits stack.
+func stackMatches(entryStacks []string, stack string) bool {
+	if len(entryStacks) == 0 || stack == "" {
+		return true
+	}
+	for _, s := range entryStacks {
+		if s == stack {
+			return true
 		}
 	}
-	return nil, newBuildpackError("FIXME", "dependency %s %s not found", dep.Name, dep.Version)
+	return false
+}
+
+var semverPattern = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
+// parsedVersion is a best-effort semver reading of a ManifestEntry's
+// version string; non-semver versions are kept as raw for lexical matching.
+type parsedVersion struct {
+	raw      string
+	major    int
+	minor    int
+	patch    int
+	isSemver bool
+}
+
+func parseVersion(v string) parsedVersion {
+	m := semverPattern.FindStringSubmatch(v)
+	if m == nil {
+		return parsedVersion{raw: v}
+	}
+
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := atoiOr(m[2], 0)
+	patch, _ := atoiOr(m[3], 0)
+
+	return parsedVersion{raw: v, major: major, minor: minor, patch: patch, isSemver: true}
+}
+
+func atoiOr(s string, fallback int) (int, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// compare returns -1, 0, or 1 as pv is less than, equal to, or greater than
+// other. Two semver readings compare numerically; anything else falls back
+// to a lexical comparison of the raw strings so the two sides are always
+// ordered consistently with each other.
+func (pv parsedVersion) compare(other parsedVersion) int {
+	if pv.isSemver && other.isSemver {
+		if d := pv.major - other.major; d != 0 {
+			return sign(d)
+		}
+		if d := pv.minor - other.minor; d != 0 {
+			return sign(d)
+		}
+		return sign(pv.patch - other.patch)
+	}
+	return strings.Compare(pv.raw, other.raw)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// satisfies evaluates constraint, a space-separated (AND'd) list of
+// clauses such as "~1.2", "^1.2.3", ">=1.4 <2", or "1.2.x", against pv.
+func (pv parsedVersion) satisfies(constraint string) (bool, error) {
+	constraint = strings.TrimSpace(constraint)
+	if constraint == "" {
+		return false, newBuildpackError("FIXME", "empty version constraint")
+	}
+
+	if !pv.isSemver {
+		return pv.raw == constraint, nil
+	}
+
+	for _, clause := range strings.Fields(constraint) {
+		ok, err := pv.satisfiesClause(clause)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// versionPartCount reports how many of major/minor/patch were present in
+// v (1, 2, or 3; 0 if v is not a version), since parseVersion sets an
+// omitted minor/patch to 0.
+func versionPartCount(v string) int {
+	m := semverPattern.FindStringSubmatch(v)
+	if m == nil {
+		return 0
+	}
+	switch {
+	case m[3] != "":
+		return 3
+	case m[2] != "":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// clauseVersion parses the version portion of a constraint clause,
+// erroring on anything that doesn't start with a number (optionally
+// prefixed with "v").
+func clauseVersion(clause, s string) (parsedVersion, error) {
+	v := parseVersion(s)
+	if !v.isSemver {
+		return parsedVersion{}, newBuildpackError("FIXME", "malformed version constraint clause %q", clause)
+	}
+	return v, nil
+}
+
+func (pv parsedVersion) satisfiesClause(clause string) (bool, error) {
+	switch {
+	case strings.HasPrefix(clause, "^"):
+		base, err := clauseVersion(clause, clause[1:])
+		if err != nil {
+			return false, err
+		}
+		upper := parsedVersion{isSemver: true, major: base.major + 1}
+		return pv.compare(base) >= 0 && pv.compare(upper) < 0, nil
+
+	case strings.HasPrefix(clause, "~"):
+		rest := clause[1:]
+		base, err := clauseVersion(clause, rest)
+		if err != nil {
+			return false, err
+		}
+		// "~1" (major only) allows any minor/patch, same as "^1"; only
+		// "~1.2" and "~1.2.3" restrict to the 1.2.x line.
+		var upper parsedVersion
+		if versionPartCount(rest) == 1 {
+			upper = parsedVersion{isSemver: true, major: base.major + 1}
+		} else {
+			upper = parsedVersion{isSemver: true, major: base.major, minor: base.minor + 1}
+		}
+		return pv.compare(base) >= 0 && pv.compare(upper) < 0, nil
+
+	case strings.HasPrefix(clause, ">="):
+		v, err := clauseVersion(clause, clause[2:])
+		if err != nil {
+			return false, err
+		}
+		return pv.compare(v) >= 0, nil
+	case strings.HasPrefix(clause, "<="):
+		v, err := clauseVersion(clause, clause[2:])
+		if err != nil {
+			return false, err
+		}
+		return pv.compare(v) <= 0, nil
+	case strings.HasPrefix(clause, ">"):
+		v, err := clauseVersion(clause, clause[1:])
+		if err != nil {
+			return false, err
+		}
+		return pv.compare(v) > 0, nil
+	case strings.HasPrefix(clause, "<"):
+		v, err := clauseVersion(clause, clause[1:])
+		if err != nil {
+			return false, err
+		}
+		return pv.compare(v) < 0, nil
+	case strings.HasPrefix(clause, "="):
+		v, err := clauseVersion(clause, clause[1:])
+		if err != nil {
+			return false, err
+		}
+		return pv.compare(v) == 0, nil
+
+	case strings.HasSuffix(clause, ".x"), strings.HasSuffix(clause, ".X"), strings.HasSuffix(clause, ".*"):
+		rest := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(clause, ".x"), ".X"), ".*")
+		base, err := clauseVersion(clause, rest)
+		if err != nil {
+			return false, err
+		}
+		upper := parsedVersion{isSemver: true, major: base.major, minor: base.minor + 1}
+		return pv.compare(base) >= 0 && pv.compare(upper) < 0, nil
+
+	default:
+		v, err := clauseVersion(clause, clause)
+		if err != nil {
+			return false, err
+		}
+		return pv.compare(v) == 0, nil
+	}
+}
+
+// fetch resolves uri's scheme to a registered DependencySource and fetches
+// it to dest, serving cacheKey from the on-disk cache when present. Callers
+// write the verified download back to the cache themselves, so a checksum
+// failure never gets cached. It returns the mirror-resolved URI it actually
+// fetched from, so callers can log what was really hit rather than the
+// pre-mirror URI.
+func (m *Manifest) fetch(ctx context.Context, uri, dest, cacheKey string) (string, error) {
+	uri = applyMirror(uri, os.Getenv("BP_DEP_MIRROR"))
+
+	if cacheKey != "" {
+		if cached, err := cachePath(cacheKey); err == nil {
+			if _, err := os.Stat(cached); err == nil {
+				m.log().Debug("dependency.cache_hit", "uri", uri, "cache_key", cacheKey)
+				return uri, copyFile(cached, dest)
+			}
+			m.log().Debug("dependency.cache_miss", "uri", uri, "cache_key", cacheKey)
+		}
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return uri, newBuildpackError("FIXME", "invalid dependency uri %s: %s", uri, err)
+	}
+
+	source, ok := m.sources[parsed.Scheme]
+	if !ok {
+		return uri, newBuildpackError("FIXME", "no dependency source registered for scheme %q", parsed.Scheme)
+	}
+
+	ctx = withLogger(ctx, m.log())
+
+	return uri, source.Fetch(ctx, uri, dest)
+}
+
+// cachePath returns the on-disk cache location for key, creating the cache
+// directory ($XDG_CACHE_HOME/libbuildpack, falling back to
+// $HOME/.cache/libbuildpack) if needed.
+func cachePath(key string) (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".cache")
+	}
+
+	dir := filepath.Join(base, "libbuildpack")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, key), nil
+}
+
+// PrefetchAll warms the on-disk download cache for every entry in
+// ManifestEntries, fetching up to concurrency at once. progress, if
+// non-nil, is called after each dependency finishes. Entries with no
+// configured digest are skipped, since they have no cache key to warm.
+func (m *Manifest) PrefetchAll(ctx context.Context, concurrency int, progress func(done, total int)) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	entries := m.ManifestEntries
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(entries))
+	var completed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry ManifestEntry) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if entry.cacheKey() != "" {
+				errs[i] = m.prefetchOne(ctx, entry)
+			}
+
+			mu.Lock()
+			completed++
+			if progress != nil {
+				progress(completed, len(entries))
+			}
+			mu.Unlock()
+		}(i, entry)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) prefetchOne(ctx context.Context, entry ManifestEntry) error {
+	cached, err := cachePath(entry.cacheKey())
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(cached); err == nil {
+		return nil
+	}
+
+	tmp := cached + ".prefetch"
+	if _, err := m.fetch(ctx, entry.URI, tmp, ""); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := checkChecksum(tmp, entry.expectedChecksums()); err != nil {
+		return err
+	}
+
+	return copyFile(tmp, cached)
+}
+
+// applyMirror rewrites uri according to mirrorMap, a comma-separated list
+// of "from=to" pairs. The first matching prefix wins.
+func applyMirror(uri, mirrorMap string) string {
+	if mirrorMap == "" {
+		return uri
+	}
+
+	for _, pair := range strings.Split(mirrorMap, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		from, to := parts[0], parts[1]
+		if strings.HasPrefix(uri, from) {
+			return to + strings.TrimPrefix(uri, from)
+		}
+	}
+
+	return uri
 }
 
 func (m *Manifest) isCached() bool {
@@ -131,35 +866,209 @@ func (m *Manifest) isCached() bool {
 	return true
 }
 
-func checkMD5(filePath, expectedMD5 string) error {
+// checkChecksum verifies filePath against the digests in expected, keyed
+// by algorithm name ("md5", "sha256", "sha512").
+func checkChecksum(filePath string, expected map[string]string) error {
+	if len(expected) == 0 {
+		return newBuildpackError("FIXME", "no checksum configured for %s", filePath)
+	}
+
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	hashers := map[string]hash.Hash{}
+	writers := make([]io.Writer, 0, len(expected))
+	for algorithm := range expected {
+		h, err := newHasher(algorithm)
+		if err != nil {
+			return err
+		}
+		hashers[algorithm] = h
+		writers = append(writers, h)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
 		return err
 	}
 
-	hashInBytes := hash.Sum(nil)[:16]
-	actualMD5 := hex.EncodeToString(hashInBytes)
+	for algorithm, expectedDigest := range expected {
+		actualDigest := hex.EncodeToString(hashers[algorithm].Sum(nil))
+		if actualDigest != expectedDigest {
+			return newBuildpackError("FIXME", "%s mismatch: expected: %s got: %s", algorithm, expectedDigest, actualDigest)
+		}
+	}
+
+	return nil
+}
+
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, newBuildpackError("FIXME", "unsupported checksum algorithm: %s", algorithm)
+	}
+}
+
+// verifySignature checks the base64-encoded detached ed25519 signature of
+// filePath against publicKey. Verification is skipped, not failed, when no
+// public key is configured.
+func verifySignature(filePath, signature string, publicKey ed25519.PublicKey) error {
+	if len(publicKey) == 0 {
+		return nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return newBuildpackError("FIXME", "malformed signature: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
 
-	if actualMD5 != expectedMD5 {
-		return newBuildpackError("FIXME", "md5 mismatch: expected: %s got: %s", expectedMD5, actualMD5)
+	if !ed25519.Verify(publicKey, contents, sig) {
+		return newBuildpackError("FIXME", "signature verification failed for %s", filePath)
 	}
+
 	return nil
 }
 
-func downloadFile(url, dest string) error {
-	resp, err := http.Get(url)
+// httpSource fetches dependencies over plain HTTP(S), retrying with
+// exponential backoff and resuming from a ".part" file via Range requests.
+type httpSource struct {
+	client     *http.Client
+	maxRetries int
+}
+
+func (httpSource) Schemes() []string { return []string{"http", "https"} }
+
+func (s httpSource) Fetch(ctx context.Context, uri, dest string) error {
+	client := s.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	partPath := dest + ".part"
+
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err := s.fetchOnce(ctx, client, uri, partPath)
+		if err == nil {
+			return os.Rename(partPath, dest)
+		}
+
+		lastErr = err
+		if !isRetryable(err) {
+			return err
+		}
+
+		loggerFromContext(ctx).Warn("dependency.download_retry", "uri", uri, "attempt", attempt+1, "max_retries", s.maxRetries, "err", err.Error())
+	}
+
+	return lastErr
+}
+
+func (httpSource) fetchOnce(ctx context.Context, client *http.Client, uri, partPath string) error {
+	var resumeFrom int64
+	if info, err := os.Stat(partPath); err == nil {
+		resumeFrom = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 	if err != nil {
 		return err
 	}
+	if resumeFrom > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return &retryableError{err}
+	}
 	defer resp.Body.Close()
 
-	return writeToFile(resp.Body, dest)
+	if resp.StatusCode >= 500 {
+		return &retryableError{newBuildpackError("FIXME", "download failed: %s returned %d", uri, resp.StatusCode)}
+	}
+	if resp.StatusCode >= 400 {
+		return newBuildpackError("FIXME", "download failed: %s returned %d", uri, resp.StatusCode)
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		if err := appendToFile(resp.Body, partPath); err != nil {
+			return &retryableError{err}
+		}
+		return nil
+	}
+
+	// Server ignored our Range header (full 200 OK): start over.
+	if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeToFile(resp.Body, partPath); err != nil {
+		return &retryableError{err}
+	}
+	return nil
+}
+
+// retryableError marks an error as transient, worth retrying.
+type retryableError struct{ error }
+
+func isRetryable(err error) bool {
+	_, ok := err.(*retryableError)
+	return ok
+}
+
+func backoff(attempt int) time.Duration {
+	d := time.Duration(1<<uint(attempt-1)) * time.Second
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d
+}
+
+func appendToFile(source io.Reader, dest string) error {
+	fh, err := os.OpenFile(dest, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	_, err = io.Copy(fh, source)
+	return err
+}
+
+// fileSource copies a dependency out of a local path, for mirrors staged
+// onto disk ahead of time.
+type fileSource struct{}
+
+func (fileSource) Schemes() []string { return []string{"file"} }
+
+func (fileSource) Fetch(ctx context.Context, uri, dest string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	return copyFile(parsed.Path, dest)
 }
 
 func copyFile(source, dest string) error {
@@ -0,0 +1,563 @@
+package buildpack
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseVersion(t *testing.T) {
+	cases := []struct {
+		version  string
+		isSemver bool
+		major    int
+		minor    int
+		patch    int
+	}{
+		{"1.2.3", true, 1, 2, 3},
+		{"v1.2.3", true, 1, 2, 3},
+		{"1.2", true, 1, 2, 0},
+		{"1", true, 1, 0, 0},
+		{"go1.21.0", false, 0, 0, 0},
+		{"jruby-9.2.13.0", false, 0, 0, 0},
+	}
+
+	for _, c := range cases {
+		pv := parseVersion(c.version)
+		if pv.isSemver != c.isSemver {
+			t.Errorf("parseVersion(%q).isSemver = %v, want %v", c.version, pv.isSemver, c.isSemver)
+			continue
+		}
+		if !c.isSemver {
+			continue
+		}
+		if pv.major != c.major || pv.minor != c.minor || pv.patch != c.patch {
+			t.Errorf("parseVersion(%q) = %d.%d.%d, want %d.%d.%d", c.version, pv.major, pv.minor, pv.patch, c.major, c.minor, c.patch)
+		}
+	}
+}
+
+func TestParsedVersionCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.4", "1.2.3", 1},
+		{"1.2.3", "1.2.4", -1},
+		{"2.0.0", "1.9.9", 1},
+		{"1.10.0", "1.9.0", 1},
+	}
+
+	for _, c := range cases {
+		got := parseVersion(c.a).compare(parseVersion(c.b))
+		if got != c.want {
+			t.Errorf("compare(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestSatisfiesCaret(t *testing.T) {
+	cases := []struct {
+		version    string
+		constraint string
+		want       bool
+	}{
+		{"1.2.3", "^1.2.3", true},
+		{"1.9.9", "^1.2.3", true},
+		{"2.0.0", "^1.2.3", false},
+		{"1.2.2", "^1.2.3", false},
+	}
+
+	for _, c := range cases {
+		ok, err := parseVersion(c.version).satisfies(c.constraint)
+		if err != nil {
+			t.Fatalf("satisfies(%q, %q) returned error: %s", c.version, c.constraint, err)
+		}
+		if ok != c.want {
+			t.Errorf("%q satisfies %q = %v, want %v", c.version, c.constraint, ok, c.want)
+		}
+	}
+}
+
+func TestSatisfiesTilde(t *testing.T) {
+	cases := []struct {
+		version    string
+		constraint string
+		want       bool
+	}{
+		{"1.2.5", "~1.2.3", true},
+		{"1.3.0", "~1.2.3", false},
+		{"1.2.0", "~1.2", true},
+		{"1.3.0", "~1.2", false},
+		// Major-only tilde allows any minor/patch within that major.
+		{"1.9.9", "~1", true},
+		{"2.0.0", "~1", false},
+	}
+
+	for _, c := range cases {
+		ok, err := parseVersion(c.version).satisfies(c.constraint)
+		if err != nil {
+			t.Fatalf("satisfies(%q, %q) returned error: %s", c.version, c.constraint, err)
+		}
+		if ok != c.want {
+			t.Errorf("%q satisfies %q = %v, want %v", c.version, c.constraint, ok, c.want)
+		}
+	}
+}
+
+func TestSatisfiesRangeAndWildcard(t *testing.T) {
+	cases := []struct {
+		version    string
+		constraint string
+		want       bool
+	}{
+		{"1.4.0", ">=1.4 <2", true},
+		{"2.0.0", ">=1.4 <2", false},
+		{"1.3.9", ">=1.4 <2", false},
+		{"1.2.9", "1.2.x", true},
+		{"1.3.0", "1.2.x", false},
+		{"1.2.3", "1.2.3", true},
+		{"1.2.4", "1.2.3", false},
+	}
+
+	for _, c := range cases {
+		ok, err := parseVersion(c.version).satisfies(c.constraint)
+		if err != nil {
+			t.Fatalf("satisfies(%q, %q) returned error: %s", c.version, c.constraint, err)
+		}
+		if ok != c.want {
+			t.Errorf("%q satisfies %q = %v, want %v", c.version, c.constraint, ok, c.want)
+		}
+	}
+}
+
+func TestSatisfiesNonSemverFallback(t *testing.T) {
+	pv := parseVersion("jruby-9.2.13.0")
+
+	ok, err := pv.satisfies("jruby-9.2.13.0")
+	if err != nil {
+		t.Fatalf("satisfies returned error: %s", err)
+	}
+	if !ok {
+		t.Errorf("expected exact-match constraint to satisfy a non-semver version")
+	}
+
+	ok, err = pv.satisfies("jruby-9.2.12.0")
+	if err != nil {
+		t.Fatalf("satisfies returned error: %s", err)
+	}
+	if ok {
+		t.Errorf("expected a different non-semver version not to satisfy the constraint")
+	}
+}
+
+func TestSatisfiesMalformedClause(t *testing.T) {
+	_, err := parseVersion("1.2.3").satisfies("^")
+	if err == nil {
+		t.Fatalf("expected an error for a malformed clause, got none")
+	}
+}
+
+func writeTempFile(t *testing.T, contents string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "dependency.tgz")
+	if err := os.WriteFile(f, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write temp file: %s", err)
+	}
+	return f
+}
+
+func TestExpectedChecksums(t *testing.T) {
+	e := &ManifestEntry{SHA256: "abc", MD5: "def"}
+	expected := e.expectedChecksums()
+
+	if expected["sha256"] != "abc" || expected["md5"] != "def" {
+		t.Fatalf("expectedChecksums() = %#v, want sha256/md5 entries", expected)
+	}
+	if _, ok := expected["sha512"]; ok {
+		t.Errorf("expectedChecksums() included sha512 for an entry that didn't configure one")
+	}
+
+	if got := (&ManifestEntry{}).expectedChecksums(); len(got) != 0 {
+		t.Errorf("expectedChecksums() on a bare entry = %#v, want empty", got)
+	}
+}
+
+func TestCheckChecksum(t *testing.T) {
+	path := writeTempFile(t, "hello world")
+	sum := sha256.Sum256([]byte("hello world"))
+	digest := hex.EncodeToString(sum[:])
+
+	if err := checkChecksum(path, map[string]string{"sha256": digest}); err != nil {
+		t.Errorf("checkChecksum with a matching digest returned error: %s", err)
+	}
+
+	if err := checkChecksum(path, map[string]string{"sha256": "0000"}); err == nil {
+		t.Errorf("checkChecksum with a mismatched digest returned no error")
+	}
+
+	if err := checkChecksum(path, map[string]string{}); err == nil {
+		t.Errorf("checkChecksum with no expected digests returned no error")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	path := writeTempFile(t, "hello world")
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte("hello world")))
+
+	if err := verifySignature(path, sig, pub); err != nil {
+		t.Errorf("verifySignature with a valid signature returned error: %s", err)
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if err := verifySignature(path, sig, otherPub); err == nil {
+		t.Errorf("verifySignature against the wrong public key returned no error")
+	}
+
+	// No public key configured on the Manifest: verification is skipped
+	// rather than failed, so unsigned manifests keep working.
+	if err := verifySignature(path, "not-base64!!", nil); err != nil {
+		t.Errorf("verifySignature with no public key configured returned error: %s", err)
+	}
+}
+
+func TestStackMatches(t *testing.T) {
+	cases := []struct {
+		entryStacks []string
+		stack       string
+		want        bool
+	}{
+		{nil, "cflinuxfs4", true},
+		{[]string{"cflinuxfs4"}, "", true},
+		{[]string{"cflinuxfs4"}, "cflinuxfs4", true},
+		{[]string{"cflinuxfs3", "cflinuxfs4"}, "cflinuxfs4", true},
+		{[]string{"cflinuxfs3"}, "cflinuxfs4", false},
+	}
+
+	for _, c := range cases {
+		if got := stackMatches(c.entryStacks, c.stack); got != c.want {
+			t.Errorf("stackMatches(%v, %q) = %v, want %v", c.entryStacks, c.stack, got, c.want)
+		}
+	}
+}
+
+func TestArchScore(t *testing.T) {
+	target := Target{Arch: "amd64", ArchVariant: "v8"}
+
+	cases := []struct {
+		name  string
+		entry ManifestEntry
+		want  int
+	}{
+		{"no arch set matches anything", ManifestEntry{}, 1},
+		{"arch mismatch", ManifestEntry{Arch: "arm64"}, -1},
+		{"arch match, no variant constraint", ManifestEntry{Arch: "amd64"}, 2},
+		{"arch and variant both match exactly", ManifestEntry{Arch: "amd64", ArchVariant: "v8"}, 3},
+		{"arch matches but variant doesn't", ManifestEntry{Arch: "amd64", ArchVariant: "v7"}, -1},
+	}
+
+	for _, c := range cases {
+		if got := archScore(&c.entry, target); got != c.want {
+			t.Errorf("%s: archScore = %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	// Exact variant match should outrank a plain arch match, so
+	// getEntryFor picks the more specific entry.
+	exact := archScore(&ManifestEntry{Arch: "amd64", ArchVariant: "v8"}, target)
+	plain := archScore(&ManifestEntry{Arch: "amd64"}, target)
+	any := archScore(&ManifestEntry{}, target)
+	if !(exact > plain && plain > any) {
+		t.Errorf("expected precedence exact(%d) > plain(%d) > any(%d)", exact, plain, any)
+	}
+}
+
+func TestGetEntryForPrefersMostSpecificArch(t *testing.T) {
+	m := &Manifest{
+		ManifestEntries: []ManifestEntry{
+			{Dependency: Dependency{Name: "go", Version: "1.21.0"}, Arch: "amd64"},
+			{Dependency: Dependency{Name: "go", Version: "1.21.0"}, Arch: "amd64", ArchVariant: "v8"},
+			{Dependency: Dependency{Name: "go", Version: "1.21.0"}},
+		},
+	}
+
+	entry, err := m.getEntryFor(Dependency{Name: "go", Version: "1.21.0"}, Target{Arch: "amd64", ArchVariant: "v8"})
+	if err != nil {
+		t.Fatalf("getEntryFor returned error: %s", err)
+	}
+	if entry.ArchVariant != "v8" {
+		t.Errorf("getEntryFor picked ArchVariant %q, want the exact v8 match", entry.ArchVariant)
+	}
+}
+
+func TestGetEntryForRespectsStack(t *testing.T) {
+	m := &Manifest{
+		ManifestEntries: []ManifestEntry{
+			{Dependency: Dependency{Name: "go", Version: "1.21.0"}, CFStacks: []string{"cflinuxfs3"}},
+		},
+	}
+
+	if _, err := m.getEntryFor(Dependency{Name: "go", Version: "1.21.0"}, Target{Stack: "cflinuxfs4"}); err == nil {
+		t.Errorf("getEntryFor matched an entry pinned to a different stack")
+	}
+
+	entry, err := m.getEntryFor(Dependency{Name: "go", Version: "1.21.0"}, Target{Stack: "cflinuxfs3"})
+	if err != nil {
+		t.Fatalf("getEntryFor returned error for a matching stack: %s", err)
+	}
+	if entry == nil {
+		t.Fatalf("getEntryFor returned a nil entry with no error")
+	}
+}
+
+func TestGetEntryResolvesHostArch(t *testing.T) {
+	m := &Manifest{
+		ManifestEntries: []ManifestEntry{
+			{Dependency: Dependency{Name: "go", Version: "1.21.0"}, URI: "file:///wrong-arch", Arch: "bogus-arch"},
+			{Dependency: Dependency{Name: "go", Version: "1.21.0"}, URI: "file:///right-arch", Arch: runtime.GOARCH},
+		},
+	}
+
+	entry, err := m.getEntry(Dependency{Name: "go", Version: "1.21.0"})
+	if err != nil {
+		t.Fatalf("getEntry returned error: %s", err)
+	}
+	if entry.URI != "file:///right-arch" {
+		t.Errorf("getEntry picked URI %q, want the entry matching the host arch", entry.URI)
+	}
+}
+
+func TestGetEntryErrorsWhenNoEntryMatchesHostArch(t *testing.T) {
+	m := &Manifest{
+		ManifestEntries: []ManifestEntry{
+			{Dependency: Dependency{Name: "go", Version: "1.21.0"}, Arch: "bogus-arch"},
+		},
+	}
+
+	if _, err := m.getEntry(Dependency{Name: "go", Version: "1.21.0"}); err == nil {
+		t.Errorf("getEntry matched an entry pinned to a different architecture")
+	}
+}
+
+func TestApplyMirror(t *testing.T) {
+	mirrorMap := "https://buildpacks.cloudfoundry.org=https://mirror.internal,https://nodejs.org/dist=https://mirror.internal/node"
+
+	cases := []struct {
+		uri  string
+		want string
+	}{
+		{"https://buildpacks.cloudfoundry.org/go/go1.21.0.tgz", "https://mirror.internal/go/go1.21.0.tgz"},
+		{"https://nodejs.org/dist/v18.0.0/node.tar.gz", "https://mirror.internal/node/v18.0.0/node.tar.gz"},
+		{"https://example.com/other.tgz", "https://example.com/other.tgz"},
+	}
+
+	for _, c := range cases {
+		if got := applyMirror(c.uri, mirrorMap); got != c.want {
+			t.Errorf("applyMirror(%q) = %q, want %q", c.uri, got, c.want)
+		}
+	}
+
+	if got := applyMirror("https://example.com/x.tgz", ""); got != "https://example.com/x.tgz" {
+		t.Errorf("applyMirror with an empty mirrorMap should return uri unchanged, got %q", got)
+	}
+}
+
+func TestHTTPSourceFetchSuccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("payload"))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	s := httpSource{client: server.Client()}
+	if err := s.Fetch(context.Background(), server.URL, dest); err != nil {
+		t.Fatalf("Fetch returned error: %s", err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("failed to read fetched file: %s", err)
+	}
+	if string(got) != "payload" {
+		t.Errorf("fetched contents = %q, want %q", got, "payload")
+	}
+}
+
+func TestHTTPSourceFetchRetriesOn5xxThenSucceeds(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("payload"))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	s := httpSource{client: server.Client(), maxRetries: 3}
+	if err := s.Fetch(context.Background(), server.URL, dest); err != nil {
+		t.Fatalf("Fetch returned error: %s", err)
+	}
+	if requests != 3 {
+		t.Errorf("server saw %d requests, want 3 (two failures then a success)", requests)
+	}
+}
+
+func TestHTTPSourceFetchGivesUpImmediatelyOn4xx(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	s := httpSource{client: server.Client(), maxRetries: 3}
+	if err := s.Fetch(context.Background(), server.URL, dest); err == nil {
+		t.Fatalf("expected Fetch to fail for a 404")
+	}
+	if requests != 1 {
+		t.Errorf("server saw %d requests, want 1 (a 4xx should not be retried)", requests)
+	}
+}
+
+func TestHTTPSourceFetchResumesFromPartFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" {
+			w.Header().Set("Content-Range", "bytes 3-6/7")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("load"))
+			return
+		}
+		w.Write([]byte("payload"))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(dest+".part", []byte("pay"), 0644); err != nil {
+		t.Fatalf("failed to seed .part file: %s", err)
+	}
+
+	s := httpSource{client: server.Client()}
+	if err := s.Fetch(context.Background(), server.URL, dest); err != nil {
+		t.Fatalf("Fetch returned error: %s", err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("failed to read fetched file: %s", err)
+	}
+	if string(got) != "payload" {
+		t.Errorf("fetched contents = %q, want %q (resumed, not restarted)", got, "payload")
+	}
+}
+
+func TestHTTPSourceFetchRetriesMidStreamError(t *testing.T) {
+	// A server that closes the connection after a partial write should be
+	// treated the same as a failed connect: retried, not failed outright.
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("short"))
+			if hj, ok := w.(http.Hijacker); ok {
+				conn, _, _ := hj.Hijack()
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte("payload"))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	s := httpSource{client: server.Client(), maxRetries: 3}
+	if err := s.Fetch(context.Background(), server.URL, dest); err != nil {
+		t.Fatalf("Fetch returned error: %s", err)
+	}
+	if requests < 2 {
+		t.Errorf("server saw %d requests, want a retry after the dropped connection", requests)
+	}
+}
+
+func TestCachePath(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	path, err := cachePath("sha256-abc")
+	if err != nil {
+		t.Fatalf("cachePath returned error: %s", err)
+	}
+	if filepath.Base(path) != "sha256-abc" {
+		t.Errorf("cachePath = %q, want a path ending in the cache key", path)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		t.Errorf("cachePath did not create its parent directory")
+	}
+}
+
+func TestPrefetchAllSkipsEntriesWithoutDigest(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("payload"))
+	}))
+	defer server.Close()
+
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	sum := sha256.Sum256([]byte("payload"))
+	digest := hex.EncodeToString(sum[:])
+
+	m := &Manifest{
+		ManifestEntries: []ManifestEntry{
+			{Dependency: Dependency{Name: "with-digest", Version: "1.0"}, URI: server.URL, SHA256: digest},
+			{Dependency: Dependency{Name: "no-digest", Version: "1.0"}, URI: server.URL},
+		},
+		HTTPClient: server.Client(),
+	}
+	m.registerDefaultSources()
+
+	if err := m.PrefetchAll(context.Background(), 2, nil); err != nil {
+		t.Fatalf("PrefetchAll returned error: %s", err)
+	}
+	if requests != 1 {
+		t.Errorf("server saw %d requests, want 1 (only the entry with a digest should be prefetched)", requests)
+	}
+}
+
+func TestJSONLoggerPreservesValueTypes(t *testing.T) {
+	var buf bytes.Buffer
+	l := JSONLogger{Writer: &buf}
+
+	l.Info("dependency.fetched", "bytes", int64(1024), "elapsed", 2*time.Second)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("failed to decode logged JSON: %s", err)
+	}
+
+	if _, ok := decoded["bytes"].(float64); !ok {
+		t.Errorf("bytes field = %#v (%T), want a JSON number", decoded["bytes"], decoded["bytes"])
+	}
+	if _, ok := decoded["elapsed"].(float64); !ok {
+		t.Errorf("elapsed field = %#v (%T), want a JSON number", decoded["elapsed"], decoded["elapsed"])
+	}
+}
@@ -0,0 +1,53 @@
+// Package ocisource provides an optional buildpack.DependencySource for
+// oci://registry/repository@sha256:digest URIs, kept out of the core
+// manifest package so buildpacks that don't fetch from OCI registries
+// don't pay for the go-containerregistry import.
+package ocisource
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+// Source fetches a dependency as a single-layer blob from an OCI registry.
+// Register it with manifest.RegisterSource to opt in.
+type Source struct{}
+
+func (Source) Schemes() []string { return []string{"oci"} }
+
+func (Source) Fetch(ctx context.Context, uri, dest string) error {
+	ref := strings.TrimPrefix(uri, "oci://")
+
+	layer, err := crane.PullLayer(ref)
+	if err != nil {
+		return err
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return writeToFile(rc, dest)
+}
+
+func writeToFile(source io.Reader, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+
+	fh, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	_, err = io.Copy(fh, source)
+	return err
+}
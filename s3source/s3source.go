@@ -0,0 +1,64 @@
+// Package s3source provides an optional buildpack.DependencySource for
+// s3://bucket/key URIs, kept out of the core manifest package so buildpacks
+// that don't fetch from S3 don't pay for the aws-sdk-go-v2 import.
+package s3source
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Source fetches a dependency from an S3-compatible object store using the
+// ambient AWS credential chain, addressed as s3://bucket/key. Register it
+// with manifest.RegisterSource to opt in.
+type Source struct{}
+
+func (Source) Schemes() []string { return []string{"s3"} }
+
+func (Source) Fetch(ctx context.Context, uri, dest string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	bucket := parsed.Host
+	key := strings.TrimPrefix(parsed.Path, "/")
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	out, err := s3.NewFromConfig(cfg).GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	return writeToFile(out.Body, dest)
+}
+
+func writeToFile(source io.Reader, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+
+	fh, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	_, err = io.Copy(fh, source)
+	return err
+}